@@ -0,0 +1,159 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/belak/irc"
+)
+
+func TestAwayCallback(t *testing.T) {
+	s := newTestState()
+	s.ensureUserInChannel("alice", "#test")
+
+	s.awayCallback(nil, &irc.Message{
+		Prefix:  &irc.Prefix{Name: "alice"},
+		Command: "AWAY",
+		Params:  []string{"gone fishing"},
+	})
+
+	u, _ := s.getUser("alice")
+	if !u.Away {
+		t.Error("alice should be away after AWAY with a message")
+	}
+
+	s.awayCallback(nil, &irc.Message{
+		Prefix:  &irc.Prefix{Name: "alice"},
+		Command: "AWAY",
+		Params:  nil,
+	})
+
+	if u.Away {
+		t.Error("alice should not be away after AWAY with no params")
+	}
+}
+
+func TestAwayCallbackUnknownUser(t *testing.T) {
+	s := newTestState()
+
+	// Should be a no-op rather than panicking.
+	s.awayCallback(nil, &irc.Message{
+		Prefix:  &irc.Prefix{Name: "nobody"},
+		Command: "AWAY",
+		Params:  []string{"gone"},
+	})
+}
+
+func TestChghostCallback(t *testing.T) {
+	s := newTestState()
+	s.ensureUserInChannel("alice", "#test")
+
+	s.chghostCallback(nil, &irc.Message{
+		Prefix:  &irc.Prefix{Name: "alice"},
+		Command: "CHGHOST",
+		Params:  []string{"newuser", "new.host"},
+	})
+
+	u, _ := s.getUser("alice")
+	if u.Username != "newuser" || u.Host != "new.host" {
+		t.Errorf("Username/Host: got %q/%q, want \"newuser\"/\"new.host\"", u.Username, u.Host)
+	}
+}
+
+func TestSetnameCallback(t *testing.T) {
+	s := newTestState()
+	s.ensureUserInChannel("alice", "#test")
+
+	s.setnameCallback(nil, &irc.Message{
+		Prefix:  &irc.Prefix{Name: "alice"},
+		Command: "SETNAME",
+		Params:  []string{"Alice Realname"},
+	})
+
+	u, _ := s.getUser("alice")
+	if u.Realname != "Alice Realname" {
+		t.Errorf("Realname: got %q, want \"Alice Realname\"", u.Realname)
+	}
+}
+
+func TestAccountCallback(t *testing.T) {
+	s := newTestState()
+	s.ensureUserInChannel("alice", "#test")
+
+	s.accountCallback(nil, &irc.Message{
+		Prefix:  &irc.Prefix{Name: "alice"},
+		Command: "ACCOUNT",
+		Params:  []string{"alice-account"},
+	})
+
+	u, _ := s.getUser("alice")
+	if u.Account != "alice-account" {
+		t.Errorf("Account: got %q, want \"alice-account\"", u.Account)
+	}
+
+	s.accountCallback(nil, &irc.Message{
+		Prefix:  &irc.Prefix{Name: "alice"},
+		Command: "ACCOUNT",
+		Params:  []string{"*"},
+	})
+
+	if u.Account != "" {
+		t.Errorf("Account after logout (\"*\"): got %q, want \"\"", u.Account)
+	}
+}
+
+func TestInviteCallback(t *testing.T) {
+	s := newTestState()
+
+	s.inviteCallback(nil, &irc.Message{
+		Prefix:  &irc.Prefix{Name: "bob"},
+		Command: "INVITE",
+		Params:  []string{"alice", "#test"},
+	})
+
+	c, ok := s.getChannel("#test")
+	if !ok {
+		t.Fatal("#test should have been created")
+	}
+
+	if _, ok := c.Invites[s.Normalize("alice")]; !ok {
+		t.Error("alice should have a tracked invite for #test")
+	}
+}
+
+func TestJoinCallbackExtendedJoin(t *testing.T) {
+	s := newTestState()
+	s.currentNick = "bot"
+	s.ensureUserInChannel("bot", "#test")
+
+	s.joinCallback(nil, &irc.Message{
+		Prefix:  &irc.Prefix{Name: "alice"},
+		Command: "JOIN",
+		Params:  []string{"#test", "alice-account", "Alice Realname"},
+	})
+
+	u, ok := s.getUser("alice")
+	if !ok {
+		t.Fatal("alice should have been added to state")
+	}
+
+	if u.Account != "alice-account" || u.Realname != "Alice Realname" {
+		t.Errorf("Account/Realname: got %q/%q, want \"alice-account\"/\"Alice Realname\"", u.Account, u.Realname)
+	}
+}
+
+func TestJoinCallbackExtendedJoinNoAccount(t *testing.T) {
+	s := newTestState()
+	s.currentNick = "bot"
+	s.ensureUserInChannel("bot", "#test")
+
+	s.joinCallback(nil, &irc.Message{
+		Prefix:  &irc.Prefix{Name: "alice"},
+		Command: "JOIN",
+		Params:  []string{"#test", "*", "Alice Realname"},
+	})
+
+	u, _ := s.getUser("alice")
+	if u.Account != "" {
+		t.Errorf("Account with \"*\": got %q, want \"\"", u.Account)
+	}
+}
@@ -0,0 +1,99 @@
+package state
+
+// CasemapMap is a map container keyed by IRC names (nicks or channels)
+// which stores its keys in casemapped form internally, but preserves
+// the original spelling for iteration and lookup results. It re-keys
+// itself whenever the server's active CASEMAPPING changes, so entries
+// stored under one casemapping don't become unreachable after the
+// server switches to another (e.g. on reconnect to a different
+// server).
+type CasemapMap struct {
+	s       *State
+	entries map[string]*casemapEntry
+}
+
+type casemapEntry struct {
+	original string
+	value    interface{}
+}
+
+func (s *State) newCasemapMap() *CasemapMap {
+	return &CasemapMap{
+		s:       s,
+		entries: make(map[string]*casemapEntry),
+	}
+}
+
+// Get returns the value stored under key, using whatever casing key
+// happens to be in.
+func (m *CasemapMap) Get(key string) (interface{}, bool) {
+	_, v, ok := m.Entry(key)
+	return v, ok
+}
+
+// Entry returns the original (pretty) spelling of key along with its
+// value, using whatever casing key happens to be in for the lookup.
+func (m *CasemapMap) Entry(key string) (string, interface{}, bool) {
+	e, ok := m.entries[m.s.Normalize(key)]
+	if !ok {
+		return "", nil, false
+	}
+
+	return e.original, e.value, true
+}
+
+// Set stores value under key, preserving key's original spelling for
+// iteration via ForEach.
+func (m *CasemapMap) Set(key string, value interface{}) {
+	normalized := m.s.Normalize(key)
+
+	e, ok := m.entries[normalized]
+	if !ok {
+		e = &casemapEntry{}
+		m.entries[normalized] = e
+	}
+
+	e.original = key
+	e.value = value
+}
+
+// Delete removes the entry stored under key, if any.
+func (m *CasemapMap) Delete(key string) {
+	delete(m.entries, m.s.Normalize(key))
+}
+
+// Len returns the number of entries in the map.
+func (m *CasemapMap) Len() int {
+	return len(m.entries)
+}
+
+// ForEach calls fn once for every entry in the map, passing the
+// original (non-casemapped) spelling of the key.
+func (m *CasemapMap) ForEach(fn func(originalKey string, v interface{})) {
+	for _, e := range m.entries {
+		fn(e.original, e.value)
+	}
+}
+
+// Rekey re-casemaps every key in the map using the current
+// CASEMAPPING. This must be called whenever the server's active
+// casemapping changes, otherwise entries stored under the old
+// casemapping become unreachable.
+//
+// It returns a map from each entry's old (pre-rekey) normalized key
+// to its new one, so sibling data structures keyed the same way but
+// not stored in a CasemapMap (e.g. ChannelState.UserPrefixes) can be
+// moved in lockstep by the caller.
+func (m *CasemapMap) Rekey() map[string]string {
+	old := m.entries
+	m.entries = make(map[string]*casemapEntry, len(old))
+
+	moved := make(map[string]string, len(old))
+	for oldKey, e := range old {
+		newKey := m.s.Normalize(e.original)
+		m.entries[newKey] = e
+		moved[oldKey] = newKey
+	}
+
+	return moved
+}
@@ -74,14 +74,19 @@ func RFC1459ToUpper(r rune) rune {
 // Normalize is mostly an internal function which provides a
 // normalized name based on the CASEMAPPING setting given by the
 // server. Generally ToLower or ToUpper should be used.
+//
+// Like ToLower/ToUpper, callers must already hold s.mu (for reading
+// or writing) - it's called from deep inside CasemapMap and other
+// locked code paths, so it doesn't take the lock itself.
 func (s *State) Normalize(name string) string {
 	return s.ToLower(name)
 }
 
 // ToLower takes the given string and lower cases it based on the
-// current CASEMAPPING setting given by the server.
+// current CASEMAPPING setting given by the server. Callers must
+// already hold s.mu.
 func (s *State) ToLower(name string) string {
-	switch *s.ISupport("CASEMAPPING") {
+	switch *s.isupportLocked("CASEMAPPING") {
 	case "ascii":
 		return strings.Map(ASCIIToLower, name)
 	case "strict-rfc1459":
@@ -92,9 +97,10 @@ func (s *State) ToLower(name string) string {
 }
 
 // ToUpper takes the given string and upper cases it based on the
-// current CASEMAPPING setting given by the server.
+// current CASEMAPPING setting given by the server. Callers must
+// already hold s.mu.
 func (s *State) ToUpper(name string) string {
-	switch *s.ISupport("CASEMAPPING") {
+	switch *s.isupportLocked("CASEMAPPING") {
 	case "ascii":
 		return strings.Map(ASCIIToUpper, name)
 	case "strict-rfc1459":
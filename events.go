@@ -0,0 +1,114 @@
+package state
+
+import "log"
+
+// subscriberBufferSize is how many events a subscriber can lag behind
+// before new events are dropped for it.
+const subscriberBufferSize = 64
+
+// StateEvent is implemented by every event type emitted on a
+// subscription channel. It exists purely to keep the channel typed
+// while still allowing multiple concrete event types.
+type StateEvent interface {
+	isStateEvent()
+}
+
+// UserJoined is emitted when a user (possibly us) joins a channel.
+type UserJoined struct {
+	User    string
+	Channel string
+}
+
+// UserParted is emitted when a user leaves a channel, whether by
+// PART or KICK.
+type UserParted struct {
+	User    string
+	Channel string
+}
+
+// UserQuit is emitted when a user disconnects from the server.
+type UserQuit struct {
+	User string
+}
+
+// NickChanged is emitted when a user changes their nick.
+type NickChanged struct {
+	OldNick string
+	NewNick string
+}
+
+// ModeChanged is emitted when a channel mode is set or unset. Param
+// holds the mode's argument, if any.
+type ModeChanged struct {
+	Channel string
+	Mode    rune
+	Set     bool
+	Param   string
+}
+
+// PrefixChanged is emitted when a user's channel prefix (e.g. op,
+// voice) is set or unset.
+type PrefixChanged struct {
+	User    string
+	Channel string
+	Prefix  rune
+	Set     bool
+}
+
+// TopicChanged is emitted when a channel's topic is changed.
+type TopicChanged struct {
+	Channel string
+	Topic   string
+	SetBy   string
+}
+
+func (UserJoined) isStateEvent()    {}
+func (UserParted) isStateEvent()    {}
+func (UserQuit) isStateEvent()      {}
+func (NickChanged) isStateEvent()   {}
+func (ModeChanged) isStateEvent()   {}
+func (PrefixChanged) isStateEvent() {}
+func (TopicChanged) isStateEvent()  {}
+
+// Subscribe returns a channel which will receive every StateEvent
+// emitted from this point forward, along with a function to cancel
+// the subscription. Callers MUST call the cancel function when done
+// to avoid leaking the channel.
+//
+// The channel is buffered; if a subscriber falls too far behind,
+// further events are dropped for it rather than blocking state
+// processing.
+func (s *State) Subscribe() (<-chan StateEvent, func()) {
+	ch := make(chan StateEvent, subscriberBufferSize)
+
+	s.subMu.Lock()
+	s.subs[ch] = struct{}{}
+	s.subMu.Unlock()
+
+	cancel := func() {
+		s.subMu.Lock()
+		defer s.subMu.Unlock()
+
+		if _, ok := s.subs[ch]; ok {
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+
+	return ch, cancel
+}
+
+// emit sends ev to every current subscriber, dropping it for any
+// subscriber whose buffer is full.
+func (s *State) emit(ev StateEvent) {
+	s.subMu.RLock()
+	defer s.subMu.RUnlock()
+
+	for ch := range s.subs {
+		select {
+		case ch <- ev:
+		default:
+			log.Printf("state: dropping %T event for slow subscriber", ev)
+		}
+	}
+}
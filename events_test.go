@@ -0,0 +1,70 @@
+package state
+
+import "testing"
+
+func TestSubscribeReceivesEmittedEvents(t *testing.T) {
+	s := newTestState()
+
+	ch, cancel := s.Subscribe()
+	defer cancel()
+
+	s.emit(UserJoined{User: "alice", Channel: "#test"})
+
+	select {
+	case ev := <-ch:
+		joined, ok := ev.(UserJoined)
+		if !ok || joined.User != "alice" || joined.Channel != "#test" {
+			t.Errorf("got %#v, want UserJoined{User: \"alice\", Channel: \"#test\"}", ev)
+		}
+	default:
+		t.Fatal("subscriber should have received the emitted event")
+	}
+}
+
+func TestSubscribeCancelStopsDelivery(t *testing.T) {
+	s := newTestState()
+
+	ch, cancel := s.Subscribe()
+	cancel()
+
+	s.emit(UserJoined{User: "alice", Channel: "#test"})
+
+	if _, ok := <-ch; ok {
+		t.Error("channel should be closed after cancel, not delivering events")
+	}
+}
+
+func TestEmitDropsForSlowSubscriber(t *testing.T) {
+	s := newTestState()
+
+	ch, cancel := s.Subscribe()
+	defer cancel()
+
+	// Fill the subscriber's buffer, then one more - the extra event
+	// should be dropped rather than blocking emit.
+	for i := 0; i < subscriberBufferSize+1; i++ {
+		s.emit(UserQuit{User: "alice"})
+	}
+
+	count := 0
+	for {
+		select {
+		case <-ch:
+			count++
+			continue
+		default:
+		}
+		break
+	}
+
+	if count != subscriberBufferSize {
+		t.Errorf("got %d buffered events, want %d (the overflow event should be dropped)", count, subscriberBufferSize)
+	}
+}
+
+func TestEmitDoesNotBlockWithNoSubscribers(t *testing.T) {
+	s := newTestState()
+
+	// Should simply be a no-op, not panic or block.
+	s.emit(UserQuit{User: "alice"})
+}
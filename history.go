@@ -0,0 +1,309 @@
+package state
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/belak/irc"
+	"github.com/belak/seabird/bot"
+)
+
+// defaultHistoryDir is where NewStatePlugin logs history to by
+// default.
+const defaultHistoryDir = "state-history"
+
+// StoredMessage is a single logged event, as returned by MessageStore
+// and State.History.
+type StoredMessage struct {
+	// ID is a monotonically increasing cursor assigned by the
+	// MessageStore. Callers which want to resume from where they
+	// left off should track the last ID seen rather than relying on
+	// Time alone, since several messages can share a timestamp.
+	ID uint64
+
+	Time time.Time
+
+	// Target is the casemapped channel or nick this message was
+	// logged against, so logs stay stable across nick-case wobble
+	// the same way our other casemapping-aware containers do.
+	Target string
+
+	// Command is the IRC command which produced this entry, e.g.
+	// PRIVMSG, NOTICE, JOIN, PART, QUIT, NICK, MODE or TOPIC.
+	Command string
+
+	// From is the nick (or server name) which caused this entry.
+	From string
+
+	// Params holds any further command params, such as the mode
+	// arguments for MODE.
+	Params []string
+
+	// Text is the entry's main text, if any: the message body for
+	// PRIVMSG/NOTICE, the topic for TOPIC, the new nick for NICK,
+	// the mode string for MODE, the part/quit reason, and so on.
+	Text string
+}
+
+// MessageStore persists StoredMessages and allows paging back through
+// them by target. Implementations must be safe for concurrent use.
+//
+// This is the supported mechanism for other in-process seabird
+// plugins to read logged history: there's no way for a downstream
+// IRC client to page through it directly, since BasicMux only
+// dispatches messages coming from the upstream server, not commands
+// sent by a client to us - a CHATHISTORY-style protocol responder
+// could never actually be reached. Plugins which want scrollback or
+// catch-up should hold a reference to the State and call
+// State.History/State.HistorySince directly instead.
+type MessageStore interface {
+	// Append records msg against msg.Target, assigning it a
+	// monotonically increasing ID which is returned.
+	Append(msg StoredMessage) (uint64, error)
+
+	// Before returns up to limit messages logged against target
+	// strictly before the given time, most recent first.
+	Before(target string, before time.Time, limit int) ([]StoredMessage, error)
+
+	// Since returns up to limit messages logged against target with
+	// an ID greater than afterID, oldest first. A limit of 0 or
+	// less returns every such message. Callers resuming
+	// from a known point should prefer this over Before, since
+	// several messages can share a Time.
+	Since(target string, afterID uint64, limit int) ([]StoredMessage, error)
+}
+
+// FileMessageStore is the default MessageStore. It keeps one
+// JSON-lines file per casemapped target under its directory, and an in-memory
+// index of every target's messages so Before doesn't need to re-read
+// from disk on every call.
+type FileMessageStore struct {
+	dir string
+
+	mu       sync.Mutex
+	nextID   uint64
+	byTarget map[string][]StoredMessage
+}
+
+// NewFileMessageStore opens (creating if necessary) a file-backed
+// MessageStore rooted at dir, replaying any existing logs to rebuild
+// its in-memory index.
+func NewFileMessageStore(dir string) (*FileMessageStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	store := &FileMessageStore{
+		dir:      dir,
+		byTarget: make(map[string][]StoredMessage),
+	}
+
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *FileMessageStore) load() error {
+	entries, err := os.ReadDir(store.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".jsonl" {
+			continue
+		}
+
+		f, err := os.Open(filepath.Join(store.dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var msg StoredMessage
+			if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+				continue
+			}
+
+			store.byTarget[msg.Target] = append(store.byTarget[msg.Target], msg)
+			if msg.ID >= store.nextID {
+				store.nextID = msg.ID + 1
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// filename returns the path the given (already casemapped) target is
+// logged under. Path separators are replaced so a target can never
+// escape dir.
+func (store *FileMessageStore) filename(target string) string {
+	safe := strings.ReplaceAll(target, string(filepath.Separator), "_")
+	return filepath.Join(store.dir, safe+".jsonl")
+}
+
+func (store *FileMessageStore) Append(msg StoredMessage) (uint64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	msg.ID = store.nextID
+	store.nextID++
+
+	f, err := os.OpenFile(store.filename(msg.Target), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+
+	store.byTarget[msg.Target] = append(store.byTarget[msg.Target], msg)
+
+	return msg.ID, nil
+}
+
+func (store *FileMessageStore) Before(target string, before time.Time, limit int) ([]StoredMessage, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	all := store.byTarget[target]
+
+	var out []StoredMessage
+	for i := len(all) - 1; i >= 0 && len(out) < limit; i-- {
+		if all[i].Time.Before(before) {
+			out = append(out, all[i])
+		}
+	}
+
+	return out, nil
+}
+
+func (store *FileMessageStore) Since(target string, afterID uint64, limit int) ([]StoredMessage, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	all := store.byTarget[target]
+
+	var out []StoredMessage
+	for _, msg := range all {
+		if msg.ID <= afterID {
+			continue
+		}
+
+		out = append(out, msg)
+		if limit > 0 && len(out) >= limit {
+			break
+		}
+	}
+
+	return out, nil
+}
+
+// logEvent appends an entry to s's configured MessageStore, if any.
+// Callers must already hold s.mu for reading or writing.
+func (s *State) logEvent(target, command, from string, params []string, text string) {
+	if s.history == nil {
+		return
+	}
+
+	msg := StoredMessage{
+		Time:    time.Now(),
+		Target:  s.Normalize(target),
+		Command: command,
+		From:    from,
+		Params:  params,
+		Text:    text,
+	}
+
+	if _, err := s.history.Append(msg); err != nil {
+		log.Printf("state: failed to log %s to history: %v", command, err)
+	}
+}
+
+// History returns up to limit messages logged against target (a
+// channel or nick) strictly before the given time, most recent
+// first. It returns nil if no MessageStore is configured.
+func (s *State) History(target string, before time.Time, limit int) []StoredMessage {
+	s.mu.RLock()
+	store := s.history
+	normalized := s.Normalize(target)
+	s.mu.RUnlock()
+
+	if store == nil {
+		return nil
+	}
+
+	msgs, err := store.Before(normalized, before, limit)
+	if err != nil {
+		log.Printf("state: failed to read history for %s: %v", target, err)
+		return nil
+	}
+
+	return msgs
+}
+
+// HistorySince returns up to limit messages logged against target (a
+// channel or nick) with an ID greater than afterID, oldest first. A
+// limit of 0 or less returns every such message. It returns nil if
+// no MessageStore is configured.
+//
+// Plugins catching up on messages they might have missed should track
+// the last ID they saw and pass it back in here, rather than using
+// History with a remembered Time - several messages can share a Time,
+// but IDs are unique and monotonically increasing.
+func (s *State) HistorySince(target string, afterID uint64, limit int) []StoredMessage {
+	s.mu.RLock()
+	store := s.history
+	normalized := s.Normalize(target)
+	s.mu.RUnlock()
+
+	if store == nil {
+		return nil
+	}
+
+	msgs, err := store.Since(normalized, afterID, limit)
+	if err != nil {
+		log.Printf("state: failed to read history for %s: %v", target, err)
+		return nil
+	}
+
+	return msgs
+}
+
+// NOTICE
+func (s *State) noticeCallback(b *bot.Bot, m *irc.Message) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	target := m.Params[0]
+	if !s.isChannelLocked(target) {
+		// A notice sent directly to us - log it under the
+		// sender's nick so it shows up in their query history.
+		target = m.Prefix.Name
+	}
+
+	s.logEvent(target, m.Command, m.Prefix.Name, nil, m.Trailing())
+}
+
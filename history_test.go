@@ -0,0 +1,157 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFileMessageStoreAppendAndBefore(t *testing.T) {
+	store, err := NewFileMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileMessageStore: %v", err)
+	}
+
+	base := time.Now()
+
+	for i, text := range []string{"one", "two", "three"} {
+		msg := StoredMessage{
+			Time:    base.Add(time.Duration(i) * time.Second),
+			Target:  "#test",
+			Command: "PRIVMSG",
+			From:    "alice",
+			Text:    text,
+		}
+
+		if _, err := store.Append(msg); err != nil {
+			t.Fatalf("Append(%q): %v", text, err)
+		}
+	}
+
+	got, err := store.Before("#test", base.Add(10*time.Second), 2)
+	if err != nil {
+		t.Fatalf("Before: %v", err)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("Before: got %d messages, want 2", len(got))
+	}
+
+	if got[0].Text != "three" || got[1].Text != "two" {
+		t.Errorf("Before: got texts %q, %q, want most-recent-first \"three\", \"two\"", got[0].Text, got[1].Text)
+	}
+}
+
+func TestFileMessageStoreSince(t *testing.T) {
+	store, err := NewFileMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileMessageStore: %v", err)
+	}
+
+	var ids []uint64
+	for _, text := range []string{"one", "two", "three"} {
+		id, err := store.Append(StoredMessage{
+			Time:    time.Now(),
+			Target:  "#test",
+			Command: "PRIVMSG",
+			From:    "alice",
+			Text:    text,
+		})
+		if err != nil {
+			t.Fatalf("Append(%q): %v", text, err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	got, err := store.Since("#test", ids[0], 0)
+	if err != nil {
+		t.Fatalf("Since: %v", err)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("Since: got %d messages, want 2", len(got))
+	}
+
+	if got[0].Text != "two" || got[1].Text != "three" {
+		t.Errorf("Since: got texts %q, %q, want oldest-first \"two\", \"three\"", got[0].Text, got[1].Text)
+	}
+}
+
+func TestFileMessageStoreLoadRebuildsIndex(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := NewFileMessageStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileMessageStore: %v", err)
+	}
+
+	id, err := store.Append(StoredMessage{
+		Time:    time.Now(),
+		Target:  "#test",
+		Command: "PRIVMSG",
+		From:    "alice",
+		Text:    "hello",
+	})
+	if err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	reopened, err := NewFileMessageStore(dir)
+	if err != nil {
+		t.Fatalf("NewFileMessageStore (reopen): %v", err)
+	}
+
+	got, err := reopened.Before("#test", time.Now().Add(time.Hour), 10)
+	if err != nil {
+		t.Fatalf("Before: %v", err)
+	}
+
+	if len(got) != 1 || got[0].Text != "hello" {
+		t.Fatalf("Before after reopen: got %+v, want one message with text \"hello\"", got)
+	}
+
+	// nextID must also have been restored so a fresh Append doesn't
+	// reuse an ID already on disk.
+	nextID, err := reopened.Append(StoredMessage{
+		Time:    time.Now(),
+		Target:  "#test",
+		Command: "PRIVMSG",
+		From:    "alice",
+		Text:    "world",
+	})
+	if err != nil {
+		t.Fatalf("Append (after reopen): %v", err)
+	}
+
+	if nextID <= id {
+		t.Errorf("Append after reopen: got ID %d, want greater than %d", nextID, id)
+	}
+}
+
+func TestStateHistorySince(t *testing.T) {
+	s := newTestState()
+
+	store, err := NewFileMessageStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewFileMessageStore: %v", err)
+	}
+	s.history = store
+
+	s.mu.Lock()
+	s.logEvent("#test", "PRIVMSG", "alice", nil, "one")
+	s.mu.Unlock()
+
+	first := s.History("#test", time.Now().Add(time.Hour), 1)
+	if len(first) != 1 {
+		t.Fatalf("History: got %d messages, want 1", len(first))
+	}
+
+	s.mu.Lock()
+	s.logEvent("#test", "PRIVMSG", "alice", nil, "two")
+	s.mu.Unlock()
+
+	got := s.HistorySince("#test", first[0].ID, 0)
+	if len(got) != 1 || got[0].Text != "two" {
+		t.Fatalf("HistorySince: got %+v, want one message with text \"two\"", got)
+	}
+}
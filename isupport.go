@@ -18,6 +18,7 @@ var prefixRegex = regexp.MustCompile(`\(([^)]+)\)(.+)`)
 // wasn't deemed important enough to include the default for now.
 var isupportDefaults = map[string]string{
 	"CASEMAPPING": "rfc1459",
+	"CHANMODES":   "beI,k,l,imnpstr",
 	"CHANNELLEN":  "200",
 	"CHANTYPES":   "#&",
 	"EXCEPTS":     "", // ?
@@ -32,9 +33,61 @@ var isupportDefaults = map[string]string{
 	"TARGMAX":     "", // ?
 }
 
+// ModeType classifies a channel mode letter into one of the four
+// categories described by CHANMODES; see
+// https://modern.ircdocs.horse/#mode-message for the authoritative
+// definitions.
+type ModeType int
+
+const (
+	// ModeTypeUnknown is returned for a letter which isn't part of
+	// any currently known CHANMODES category.
+	ModeTypeUnknown ModeType = iota
+
+	// ModeTypeList (type A) modes add or remove an entry from a
+	// list, such as b (ban), e (except) or I (invex). They always
+	// take a parameter.
+	ModeTypeList
+
+	// ModeTypeAlwaysParam (type B) modes always take a parameter,
+	// such as k (key).
+	ModeTypeAlwaysParam
+
+	// ModeTypeSetParam (type C) modes take a parameter only when
+	// being set, such as l (limit).
+	ModeTypeSetParam
+
+	// ModeTypeNoParam (type D) modes never take a parameter, such
+	// as m (moderated).
+	ModeTypeNoParam
+)
+
+// ModeType returns the CHANMODES category of the given channel mode
+// letter, or ModeTypeUnknown if it isn't one of the currently known
+// modes.
+func (s *State) ModeType(m rune) ModeType {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i, modes := range s.chanModes {
+		if modes[m] {
+			return ModeType(i + 1)
+		}
+	}
+
+	return ModeTypeUnknown
+}
+
 // ISupport returns the value for the given server setting as reported
 // by the server or the default.
 func (s *State) ISupport(name string) *string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.isupportLocked(name)
+}
+
+func (s *State) isupportLocked(name string) *string {
 	if v, ok := s.isupport[name]; ok {
 		return &v
 	}
@@ -50,37 +103,63 @@ func (s *State) ISupport(name string) *string {
 
 // RPL_ISUPPORT
 func (s *State) callback005(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.applyISupport(m)
+}
+
+// applyISupport does the actual work of callback005. It's split out
+// so clear() can seed defaults without taking s.mu twice.
+func (s *State) applyISupport(m *irc.Message) {
 	// Loop through all params aside from the first and last ones
 	// as the first should always be the nick and the last should
 	// always be "are supported by this server."
 	for i := 1; i < len(m.Params)-1; i++ {
 		// Ensure there's SOMETHING for the second param in
 		// the split
+		//
+		// NOTE: ISUPPORT token names are plain ASCII identifiers
+		// sent in upper case by the server, not nicks or channels,
+		// so they must NOT be run through Normalize/ToLower -
+		// that's reserved for names which are actually subject to
+		// CASEMAPPING.
 		split := strings.SplitN(m.Params[i], "=", 2)
-		split[0] = s.Normalize(split[0])
 		if len(split) != 2 {
 			split = append(split, "")
 		}
 
 		// If the param starts with a -, we reset to the
-		// default value
-		if strings.HasPrefix(split[0], "-") {
-			delete(s.isupport, split[0][1:])
+		// default value. key strips that prefix so the lookup and
+		// switch below see the bare token name either way -
+		// otherwise a reset token like "-CHANMODES" never matches
+		// the switch and the default it's meant to restore never
+		// actually gets applied.
+		key := strings.TrimPrefix(split[0], "-")
+		if key != split[0] {
+			delete(s.isupport, key)
 		} else {
 			// Set it in a generic way before moving on to
 			// the specifics
-			s.isupport[split[0]] = split[1]
+			s.isupport[key] = split[1]
 		}
 
 		// Special handling of specific ISUPPORT tokens
-		isupport := s.ISupport(split[0])
+		isupport := s.isupportLocked(key)
 		if isupport == nil {
 			continue
 		}
 
 		split[1] = *isupport
-		switch split[0] {
-		case "chanmodes":
+		switch key {
+		case "CASEMAPPING":
+			// The server changed its casemapping mid-session
+			// (this can happen on reconnect to a different
+			// server). Every key stored in a casemapping-aware
+			// container needs to be re-derived or it becomes
+			// unreachable.
+			s.rekeyAll()
+		case "CHANMODES":
 			s.chanModes = []map[rune]bool{
 				map[rune]bool{},
 				map[rune]bool{},
@@ -94,15 +173,16 @@ func (s *State) callback005(b *bot.Bot, m *irc.Message) {
 					s.chanModes[i][c] = true
 				}
 			}
-		case "chantypes":
+		case "CHANTYPES":
 			s.chanTypes = make(map[rune]bool)
 
 			for _, c := range split[1] {
 				s.chanTypes[c] = true
 			}
-		case "prefix":
+		case "PREFIX":
 			s.prefixModes = make(map[rune]rune)
 			s.modePrefixes = make(map[rune]rune)
+			s.prefixOrder = nil
 
 			prefixParts := prefixRegex.FindStringSubmatch(split[1])
 			if prefixParts == nil || len(prefixParts[1]) != len(prefixParts[2]) {
@@ -112,6 +192,10 @@ func (s *State) callback005(b *bot.Bot, m *irc.Message) {
 			for i := 0; i < len(prefixParts[1]); i++ {
 				s.modePrefixes[rune(prefixParts[1][i])] = rune(prefixParts[2][i])
 				s.prefixModes[rune(prefixParts[2][i])] = rune(prefixParts[1][i])
+				// prefixOrder holds mode letters (not prefix
+				// characters), since that's what setUserPrefix
+				// looks up in modesByUser.
+				s.prefixOrder = append(s.prefixOrder, rune(prefixParts[1][i]))
 			}
 		}
 	}
@@ -0,0 +1,89 @@
+package state
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/belak/irc"
+)
+
+func TestApplyISupportDefaults(t *testing.T) {
+	s := newTestState()
+
+	// clear() seeds defaults via synthetic "-KEY" reset tokens; make
+	// sure that actually results in populated state rather than
+	// leaving everything empty until a real 005 arrives.
+	if !s.chanTypes['#'] {
+		t.Error("chanTypes should default to including #")
+	}
+
+	if !s.chanModes[0]['b'] || !s.chanModes[0]['e'] || !s.chanModes[0]['I'] {
+		t.Error("chanModes should default to treating b/e/I as list-type (A)")
+	}
+
+	if !s.chanModes[1]['k'] {
+		t.Error("chanModes should default to treating k as always-param (B)")
+	}
+
+	if !s.chanModes[2]['l'] {
+		t.Error("chanModes should default to treating l as set-param (C)")
+	}
+
+	if !s.chanModes[3]['m'] {
+		t.Error("chanModes should default to treating m as no-param (D)")
+	}
+
+	if mode, ok := s.prefixModes['@']; !ok || mode != 'o' {
+		t.Errorf("prefixModes should default to mapping @ to o, got %q, %v", mode, ok)
+	}
+
+	if !s.IsChannel("#foo") {
+		t.Error("IsChannel(\"#foo\") should be true from defaults alone, before any real 005 arrives")
+	}
+}
+
+func TestApplyISupportResetRestoresDefault(t *testing.T) {
+	s := newTestState()
+
+	s.applyISupport(fakeISupportMessage("CHANMODES=b"))
+	if s.chanModes[0]['I'] {
+		t.Fatal("precondition failed: I should not be list-type after a custom CHANMODES=b")
+	}
+
+	s.applyISupport(fakeISupportMessage("-CHANMODES"))
+
+	if !s.chanModes[0]['I'] {
+		t.Error("a \"-CHANMODES\" reset token should restore the default, including I as list-type")
+	}
+}
+
+func TestISupportConcurrentAccess(t *testing.T) {
+	s := newTestState()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+			s.ISupport("CHANMODES")
+		}()
+
+		go func() {
+			defer wg.Done()
+			s.callback005(nil, fakeISupportMessage("CHANMODES=b"))
+		}()
+	}
+	wg.Wait()
+}
+
+func fakeISupportMessage(tokens ...string) *irc.Message {
+	params := append([]string{""}, tokens...)
+	params = append(params, "are supported by this server.")
+
+	return &irc.Message{
+		Prefix:  &irc.Prefix{},
+		Command: "005",
+		Params:  params,
+	}
+}
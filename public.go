@@ -0,0 +1,186 @@
+package state
+
+import "time"
+
+// ChannelSnapshot is a read-only, deep-copied view of a ChannelState
+// at the moment it was requested. It's safe to read from any
+// goroutine without racing the callbacks which mutate the live state.
+type ChannelSnapshot struct {
+	Name string
+
+	Topic      string
+	TopicSetBy string
+	TopicSetAt time.Time
+
+	CreatedAt time.Time
+	URL       string
+
+	Modes        map[rune]string
+	UserPrefixes map[string]string
+	Lists        map[rune]map[string]MaskEntry
+	Invites      map[string]time.Time
+
+	Users []string
+}
+
+// UserSnapshot is a read-only, deep-copied view of a UserState at the
+// moment it was requested.
+type UserSnapshot struct {
+	Name string
+
+	Away     bool
+	Username string
+	Host     string
+	Realname string
+	Account  string
+
+	Channels []string
+}
+
+func snapshotChannel(name string, c *ChannelState) ChannelSnapshot {
+	snap := ChannelSnapshot{
+		Name:         name,
+		Topic:        c.Topic,
+		TopicSetBy:   c.TopicSetBy,
+		TopicSetAt:   c.TopicSetAt,
+		CreatedAt:    c.CreatedAt,
+		URL:          c.URL,
+		Modes:        make(map[rune]string, len(c.Modes)),
+		UserPrefixes: make(map[string]string, len(c.UserPrefixes)),
+		Lists:        make(map[rune]map[string]MaskEntry, len(c.Lists)),
+		Invites:      make(map[string]time.Time, len(c.Invites)),
+	}
+
+	for k, v := range c.Modes {
+		snap.Modes[k] = v
+	}
+
+	for k, v := range c.UserPrefixes {
+		snap.UserPrefixes[k] = v
+	}
+
+	for mode, list := range c.Lists {
+		entries := make(map[string]MaskEntry, len(list))
+		for mask, entry := range list {
+			entries[mask] = entry
+		}
+		snap.Lists[mode] = entries
+	}
+
+	for k, v := range c.Invites {
+		snap.Invites[k] = v
+	}
+
+	c.Users.ForEach(func(uname string, _ interface{}) {
+		snap.Users = append(snap.Users, uname)
+	})
+
+	return snap
+}
+
+func snapshotUser(name string, u *UserState) UserSnapshot {
+	snap := UserSnapshot{
+		Name:     name,
+		Away:     u.Away,
+		Username: u.Username,
+		Host:     u.Host,
+		Realname: u.Realname,
+		Account:  u.Account,
+	}
+
+	u.Channels.ForEach(func(cname string, _ interface{}) {
+		snap.Channels = append(snap.Channels, cname)
+	})
+
+	return snap
+}
+
+// Channel returns a snapshot of the named channel's state, if we
+// currently know about it.
+func (s *State) Channel(name string) (ChannelSnapshot, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	original, v, ok := s.Channels.Entry(name)
+	if !ok {
+		return ChannelSnapshot{}, false
+	}
+
+	return snapshotChannel(original, v.(*ChannelState)), true
+}
+
+// User returns a snapshot of the named user's state, if we currently
+// know about it.
+func (s *State) User(name string) (UserSnapshot, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	original, v, ok := s.Users.Entry(name)
+	if !ok {
+		return UserSnapshot{}, false
+	}
+
+	return snapshotUser(original, v.(*UserState)), true
+}
+
+// ChannelList returns the names of every channel the state holds an
+// entry for: the channels we're currently in, plus any channel which
+// is only known from an INVITE.
+func (s *State) ChannelList() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var names []string
+	s.Channels.ForEach(func(name string, _ interface{}) {
+		names = append(names, name)
+	})
+
+	return names
+}
+
+// CommonChannels returns the names of every channel we share with
+// user.
+func (s *State) CommonChannels(user string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.getUser(user)
+	if !ok {
+		return nil
+	}
+
+	var names []string
+	u.Channels.ForEach(func(cname string, _ interface{}) {
+		names = append(names, cname)
+	})
+
+	return names
+}
+
+// IsOp returns whether user currently holds the "op" (@) prefix in
+// channel.
+func (s *State) IsOp(user, channel string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.userHasPrefixLocked(user, channel, '@')
+}
+
+// HighestPrefix returns the highest-precedence prefix user currently
+// holds in channel, as given by the server's PREFIX order.
+func (s *State) HighestPrefix(user, channel string) (rune, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.getChannel(channel)
+	if !ok {
+		return 0, false
+	}
+
+	prefixes, ok := c.UserPrefixes[s.Normalize(user)]
+	if !ok || len(prefixes) == 0 {
+		return 0, false
+	}
+
+	return rune(prefixes[0]), true
+}
@@ -0,0 +1,138 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChannelSnapshot(t *testing.T) {
+	s := newTestState()
+	c := s.ensureChannel("#test")
+
+	s.ensureUserInChannel("alice", "#test")
+	s.applyChannelModes(c, "#test", "+ot", []string{"alice"}, "bob", time.Now(), false)
+
+	c.Topic = "topic text"
+	c.TopicSetBy = "bob"
+	c.URL = "https://example.com"
+
+	snap, ok := s.Channel("#test")
+	if !ok {
+		t.Fatal("Channel(\"#test\") should be found")
+	}
+
+	if snap.Name != "#test" {
+		t.Errorf("Name: got %q, want #test", snap.Name)
+	}
+
+	if snap.Topic != "topic text" || snap.TopicSetBy != "bob" {
+		t.Errorf("Topic/TopicSetBy: got %q/%q, want \"topic text\"/\"bob\"", snap.Topic, snap.TopicSetBy)
+	}
+
+	if snap.URL != "https://example.com" {
+		t.Errorf("URL: got %q, want https://example.com", snap.URL)
+	}
+
+	if _, ok := snap.Modes['t']; !ok {
+		t.Error("Modes should include t")
+	}
+
+	if snap.UserPrefixes[s.Normalize("alice")] != "@" {
+		t.Errorf("UserPrefixes[alice]: got %q, want @", snap.UserPrefixes[s.Normalize("alice")])
+	}
+
+	if len(snap.Users) != 1 || snap.Users[0] != "alice" {
+		t.Errorf("Users: got %v, want [alice]", snap.Users)
+	}
+
+	// The snapshot must be a copy - mutating it shouldn't affect the
+	// live state.
+	snap.Modes['x'] = ""
+	if _, ok := c.Modes['x']; ok {
+		t.Error("mutating a ChannelSnapshot's Modes leaked into the live ChannelState")
+	}
+
+	if _, ok := s.Channel("#nope"); ok {
+		t.Error("Channel(\"#nope\") should not be found")
+	}
+}
+
+func TestUserSnapshot(t *testing.T) {
+	s := newTestState()
+	s.ensureUserInChannel("alice", "#test")
+
+	u, _ := s.getUser("alice")
+	u.Away = true
+	u.Username = "alice-user"
+	u.Host = "example.com"
+	u.Account = "alice-account"
+
+	snap, ok := s.User("alice")
+	if !ok {
+		t.Fatal("User(\"alice\") should be found")
+	}
+
+	if !snap.Away || snap.Username != "alice-user" || snap.Host != "example.com" || snap.Account != "alice-account" {
+		t.Errorf("snapshot fields didn't round-trip, got %+v", snap)
+	}
+
+	if len(snap.Channels) != 1 || snap.Channels[0] != "#test" {
+		t.Errorf("Channels: got %v, want [#test]", snap.Channels)
+	}
+
+	if _, ok := s.User("bob"); ok {
+		t.Error("User(\"bob\") should not be found")
+	}
+}
+
+func TestChannelList(t *testing.T) {
+	s := newTestState()
+	s.ensureChannel("#foo")
+	s.ensureChannel("#bar")
+
+	got := s.ChannelList()
+	if len(got) != 2 {
+		t.Fatalf("ChannelList: got %v, want 2 channels", got)
+	}
+}
+
+func TestCommonChannels(t *testing.T) {
+	s := newTestState()
+	s.ensureUserInChannel("alice", "#foo")
+	s.ensureUserInChannel("alice", "#bar")
+	s.ensureUserInChannel("bob", "#foo")
+
+	got := s.CommonChannels("alice")
+	if len(got) != 2 {
+		t.Errorf("CommonChannels(alice): got %v, want 2 channels", got)
+	}
+
+	if got := s.CommonChannels("nobody"); got != nil {
+		t.Errorf("CommonChannels(nobody): got %v, want nil", got)
+	}
+}
+
+func TestIsOpAndHighestPrefix(t *testing.T) {
+	s := newTestState()
+	c := s.ensureChannel("#test")
+
+	s.ensureUserInChannel("alice", "#test")
+	s.applyChannelModes(c, "#test", "+ov", []string{"alice", "alice"}, "bob", time.Now(), false)
+
+	if !s.IsOp("alice", "#test") {
+		t.Error("alice should be op after +o")
+	}
+
+	prefix, ok := s.HighestPrefix("alice", "#test")
+	if !ok || prefix != '@' {
+		t.Errorf("HighestPrefix(alice): got %q, %v, want '@', true", string(prefix), ok)
+	}
+
+	if s.IsOp("bob", "#test") {
+		t.Error("bob should not be op")
+	}
+
+	if _, ok := s.HighestPrefix("bob", "#test"); ok {
+		t.Error("HighestPrefix(bob) should not be found")
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 	"unicode/utf8"
 
 	"github.com/belak/irc"
@@ -23,6 +26,17 @@ func init() {
 
 // State is a plugin which will track the state of users and channels.
 type State struct {
+	// mu guards every field below except subMu and subs, as
+	// callbacks run on the IRC read goroutine while Query-API
+	// callers may run on any goroutine.
+	mu sync.RWMutex
+
+	// subMu guards subs, kept separate from mu so emitting events
+	// doesn't require holding the state lock while sending on
+	// subscriber channels.
+	subMu sync.RWMutex
+	subs  map[chan StateEvent]struct{}
+
 	currentNick string
 
 	// These come from 004
@@ -37,64 +51,179 @@ type State struct {
 	prefixModes map[rune]rune
 	// o -> @
 	modePrefixes map[rune]rune
-
-	Channels map[string]*ChannelState
-	Users    map[string]*UserState
+	// prefixOrder holds the mode letters in the order given by
+	// PREFIX, highest precedence first, so per-user prefixes can be
+	// sorted consistently.
+	prefixOrder []rune
+
+	// Channels maps a channel name to its ChannelState, and Users
+	// maps a nick to its UserState. Both are keyed in a
+	// casemapping-aware way so lookups stay correct even if the
+	// server's CASEMAPPING changes mid-session.
+	Channels *CasemapMap
+	Users    *CasemapMap
+
+	// history is where PRIVMSG/NOTICE/JOIN/PART/QUIT/NICK/MODE/TOPIC
+	// events get logged, if configured. It's nil (disabled) if
+	// NewFileMessageStore failed to open defaultHistoryDir.
+	history MessageStore
 }
 
 type UserState struct {
-	Away     bool
-	Channels map[string]bool
+	Away bool
+
+	// Username, Host and Realname come from WHO replies, and are
+	// kept up to date by the chghost and setname capabilities
+	// without needing a follow-up WHO.
+	Username string
+	Host     string
+	Realname string
+
+	// Account is the services account name for this user, as
+	// reported by the account-notify and extended-join
+	// capabilities. It is empty if the user isn't logged in.
+	Account string
+
+	// Channels is the set of channels this user is known to be in,
+	// keyed in a casemapping-aware way.
+	Channels *CasemapMap
+}
+
+// MaskEntry records a single entry in a type-A (list) channel mode such
+// as a ban, except or invex, along with who set it and when.
+type MaskEntry struct {
+	Mask  string
+	SetBy string
+	SetAt time.Time
 }
 
 type ChannelState struct {
-	Users map[string]bool
+	// Users is the set of nicks known to be in this channel, keyed
+	// in a casemapping-aware way.
+	Users *CasemapMap
+
+	// Modes holds every currently-set channel mode. Parameterless
+	// modes are stored with an empty string value.
+	Modes map[rune]string
+
+	// Topic metadata, populated from RPL_TOPIC/RPL_TOPICWHOTIME and
+	// kept up to date by the TOPIC command.
+	Topic      string
+	TopicSetBy string
+	TopicSetAt time.Time
+
+	// CreatedAt is populated from RPL_CREATIONTIME.
+	CreatedAt time.Time
+
+	// URL is populated from RPL_CHANNEL_URL.
+	URL string
+
+	// UserPrefixes maps a normalized nick to the sorted prefix
+	// characters (highest first, as given by PREFIX) that nick
+	// currently holds in this channel.
+	UserPrefixes map[string]string
+
+	// Lists holds the entries for each type-A (list) mode, such as
+	// b (ban), e (except) and I (invex), keyed by mask.
+	Lists map[rune]map[string]MaskEntry
+
+	// modesByUser tracks the raw prefix mode letters (not the
+	// prefix characters) held by each normalized nick, so
+	// UserPrefixes can be recomputed in PREFIX order as modes
+	// change.
+	modesByUser map[string]map[rune]bool
+
+	// Invites tracks pending invites to this channel, keyed by
+	// normalized nick, as reported by the invite-notify
+	// capability.
+	Invites map[string]time.Time
+}
+
+func (s *State) getChannel(name string) (*ChannelState, bool) {
+	v, ok := s.Channels.Get(name)
+	if !ok {
+		return nil, false
+	}
+
+	return v.(*ChannelState), true
+}
+
+func (s *State) getUser(name string) (*UserState, bool) {
+	v, ok := s.Users.Get(name)
+	if !ok {
+		return nil, false
+	}
+
+	return v.(*UserState), true
 }
 
 func (s *State) ensureChannel(name string) *ChannelState {
-	normalizedName := s.Normalize(name)
-	c, ok := s.Channels[normalizedName]
+	c, ok := s.getChannel(name)
 	if !ok {
 		c = &ChannelState{
-			Users: make(map[string]bool),
+			Users:        s.newCasemapMap(),
+			Modes:        make(map[rune]string),
+			UserPrefixes: make(map[string]string),
+			Lists:        make(map[rune]map[string]MaskEntry),
+			modesByUser:  make(map[string]map[rune]bool),
+			Invites:      make(map[string]time.Time),
 		}
-		s.Channels[normalizedName] = c
+		s.Channels.Set(name, c)
 	}
 
 	return c
 }
 
 func (s *State) ensureUser(name string) *UserState {
-	normalizedName := s.Normalize(name)
-	u, ok := s.Users[normalizedName]
+	u, ok := s.getUser(name)
 	if !ok {
 		u = &UserState{
-			Channels: make(map[string]bool),
+			Channels: s.newCasemapMap(),
 		}
-		s.Users[normalizedName] = u
+		s.Users.Set(name, u)
 	}
 
 	return u
 }
 
 func (s *State) renameUser(oldName, newName string) {
+	u := s.ensureUser(oldName)
+	s.Users.Delete(oldName)
+	s.Users.Set(newName, u)
+
 	normalizedOld := s.Normalize(oldName)
 	normalizedNew := s.Normalize(newName)
 
-	u := s.ensureUser(oldName)
-	delete(s.Users, normalizedOld)
-	s.Users[normalizedNew] = u
-
 	// Loop through any channels we know this user is in
-	for cname := range u.Channels {
-		c := s.Channels[cname]
+	u.Channels.ForEach(func(cname string, _ interface{}) {
+		c, ok := s.getChannel(cname)
+		if !ok {
+			return
+		}
 
-		// Remove the old username
-		delete(c.Users, normalizedOld)
+		// Remove the old username and add the new one
+		c.Users.Delete(oldName)
+		c.Users.Set(newName, true)
+
+		// UserPrefixes and modesByUser are plain maps keyed by
+		// normalized nick (not CasemapMaps), so they need to be
+		// moved by hand or a user's prefixes are silently lost on
+		// every nick change.
+		if modes, ok := c.modesByUser[normalizedOld]; ok {
+			delete(c.modesByUser, normalizedOld)
+			c.modesByUser[normalizedNew] = modes
+		}
 
-		// Add the new one
-		c.Users[normalizedNew] = true
-	}
+		if prefixes, ok := c.UserPrefixes[normalizedOld]; ok {
+			delete(c.UserPrefixes, normalizedOld)
+			c.UserPrefixes[normalizedNew] = prefixes
+		}
+
+		if invitedAt, ok := c.Invites[normalizedOld]; ok {
+			delete(c.Invites, normalizedOld)
+			c.Invites[normalizedNew] = invitedAt
+		}
+	})
 }
 
 func (s *State) removeUser(name string) {
@@ -103,9 +232,9 @@ func (s *State) removeUser(name string) {
 	// We can't modify this list while we're looping through it so
 	// we need a copy.
 	var channels []string
-	for c := range u.Channels {
-		channels = append(channels, c)
-	}
+	u.Channels.ForEach(func(cname string, _ interface{}) {
+		channels = append(channels, cname)
+	})
 
 	// Because ensureUserNotInChannel will delete the user if
 	// there are no more channels left, we can ignore it here.
@@ -118,34 +247,36 @@ func (s *State) ensureUserInChannel(user, channel string) (*UserState, *ChannelS
 	// TODO: Do we want to error if the user is not the bot and
 	// the bot isn't in the channel? Might be good for
 	// consistency.
-	normalizedUser := s.Normalize(user)
-	normalizedChannel := s.Normalize(channel)
-
 	u := s.ensureUser(user)
 	c := s.ensureChannel(channel)
 
-	c.Users[normalizedUser] = true
-	u.Channels[normalizedChannel] = true
+	c.Users.Set(user, true)
+	u.Channels.Set(channel, true)
 
 	return u, c
 
 }
 
 func (s *State) ensureUserNotInChannel(user, channel string) {
-	normalizedUser := s.Normalize(user)
-	normalizedChannel := s.Normalize(channel)
-
 	// TODO: There's a chance ensureUser will add a user just to
 	// remove them. Might be good to not do this.
 	u := s.ensureUser(user)
 	c := s.ensureChannel(channel)
 
 	// Delete the current user
-	delete(c.Users, normalizedUser)
-	delete(u.Channels, normalizedChannel)
-
-	if len(u.Channels) < 1 {
-		delete(s.Users, normalizedUser)
+	c.Users.Delete(user)
+	u.Channels.Delete(channel)
+
+	// modesByUser and UserPrefixes are plain maps keyed by normalized
+	// nick (not CasemapMaps), so they don't get cleaned up for free -
+	// without this a departing user's prefix would stick around and
+	// get reapplied if they later rejoin with no fresh MODE/WHO.
+	normalized := s.Normalize(user)
+	delete(c.modesByUser, normalized)
+	delete(c.UserPrefixes, normalized)
+
+	if u.Channels.Len() < 1 {
+		s.Users.Delete(user)
 	}
 
 	// If the bot is leaving the channel, we need to remove all
@@ -154,9 +285,9 @@ func (s *State) ensureUserNotInChannel(user, channel string) {
 		// We can't modify this list while we're looping through it so
 		// we need a copy.
 		var users []string
-		for uname := range c.Users {
+		c.Users.ForEach(func(uname string, _ interface{}) {
 			users = append(users, uname)
-		}
+		})
 
 		for _, uname := range users {
 			s.ensureUserNotInChannel(uname, channel)
@@ -164,27 +295,41 @@ func (s *State) ensureUserNotInChannel(user, channel string) {
 
 		// The only time we actually remove a channel is when
 		// we leave it.
-		delete(s.Channels, normalizedChannel)
+		s.Channels.Delete(channel)
 	}
 }
 
+// UserInChannel returns whether user currently appears in channel's
+// user list.
 func (s *State) UserInChannel(user, channel string) bool {
-	user = s.Normalize(user)
-	channel = s.Normalize(channel)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.userInChannelLocked(user, channel)
+}
 
-	c, ok := s.Channels[channel]
+func (s *State) userInChannelLocked(user, channel string) bool {
+	c, ok := s.getChannel(channel)
 	if !ok {
 		return false
 	}
 
-	_, ok = c.Users[user]
+	_, ok = c.Users.Get(user)
 	return ok
 }
 
 func NewStatePlugin(b *bot.Bot) (bot.Plugin, error) {
-	s := &State{}
+	s := &State{
+		subs: make(map[chan StateEvent]struct{}),
+	}
 	s.clear()
 
+	if store, err := NewFileMessageStore(defaultHistoryDir); err != nil {
+		log.Printf("state: failed to open message history store: %v", err)
+	} else {
+		s.history = store
+	}
+
 	b.BasicMux.Event("JOIN", s.joinCallback)
 	b.BasicMux.Event("KICK", s.kickCallback)
 	b.BasicMux.Event("MODE", s.modeCallback)
@@ -192,6 +337,12 @@ func NewStatePlugin(b *bot.Bot) (bot.Plugin, error) {
 	b.BasicMux.Event("PART", s.partCallback)
 	b.BasicMux.Event("QUIT", s.quitCallback)
 
+	b.BasicMux.Event("AWAY", s.awayCallback)
+	b.BasicMux.Event("CHGHOST", s.chghostCallback)
+	b.BasicMux.Event("SETNAME", s.setnameCallback)
+	b.BasicMux.Event("ACCOUNT", s.accountCallback)
+	b.BasicMux.Event("INVITE", s.inviteCallback)
+
 	b.BasicMux.Event("001", s.callback001) // RPL_WELCOME
 	b.BasicMux.Event("004", s.callback004) // RPL_MYINFO
 	b.BasicMux.Event("005", s.callback005) // RPL_ISUPPORT
@@ -202,31 +353,58 @@ func NewStatePlugin(b *bot.Bot) (bot.Plugin, error) {
 	b.BasicMux.Event("353", s.callback353) // RPL_NAMES
 	b.BasicMux.Event("366", s.callback366) // RPL_ENDOFNAMES
 
-	// Make sure we get multi-prefix enabled as that improves some
-	// of the user prefix handling.
-	b.CapReq("multi-prefix")
-
-	/* These are callbacks which might be useful eventually
-	b.BasicMux.Event("TOPIC", s.topicCallback)
-	b.BasicMux.Event("221", s.callback221) // RPL_UMODEIS
-	b.BasicMux.Event("305", s.callback305) // RPL_UNAWAY
-	b.BasicMux.Event("306", s.callback306) // RPL_NOWAWAY
 	b.BasicMux.Event("324", s.callback324) // RPL_CHANNELMODEIS
-	b.BasicMux.Event("328", s.callback328) // RPL_CHANNEL_URL
 	b.BasicMux.Event("329", s.callback329) // RPL_CREATIONTIME
-	b.BasicMux.Event("332", s.callback332) // RPL_TOPIC
-	b.BasicMux.Event("333", s.callback333) // RPL_TOPICWHOTIME
+
 	b.BasicMux.Event("346", s.callback346) // RPL_INVITELIST
 	b.BasicMux.Event("347", s.callback347) // RPL_ENDOFINVITELIST
 	b.BasicMux.Event("348", s.callback348) // RPL_EXCEPTLIST
 	b.BasicMux.Event("349", s.callback349) // RPL_ENDOFEXCEPTLIST
 	b.BasicMux.Event("367", s.callback367) // RPL_BANLIST
 	b.BasicMux.Event("368", s.callback368) // RPL_ENDOFBANLIST
+
+	// Request the capabilities which let us keep state up to date
+	// without needing follow-up WHO requests.
+	b.CapReq("multi-prefix")
+	b.CapReq("away-notify")
+	b.CapReq("account-notify")
+	b.CapReq("extended-join")
+	b.CapReq("chghost")
+	b.CapReq("setname")
+	b.CapReq("invite-notify")
+
+	b.BasicMux.Event("TOPIC", s.topicCallback)
+	b.BasicMux.Event("328", s.callback328) // RPL_CHANNEL_URL
+	b.BasicMux.Event("332", s.callback332) // RPL_TOPIC
+	b.BasicMux.Event("333", s.callback333) // RPL_TOPICWHOTIME
+
+	b.BasicMux.Event("NOTICE", s.noticeCallback)
+
+	/* These are callbacks which might be useful eventually
+	b.BasicMux.Event("221", s.callback221) // RPL_UMODEIS
+	b.BasicMux.Event("305", s.callback305) // RPL_UNAWAY
+	b.BasicMux.Event("306", s.callback306) // RPL_NOWAWAY
 	*/
 
 	b.BasicMux.Event("PRIVMSG", func(b *bot.Bot, m *irc.Message) {
-		fmt.Printf("%+v\n", s.Users)
-		fmt.Printf("%+v\n", s.Channels)
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		s.Users.ForEach(func(name string, v interface{}) {
+			fmt.Printf("%s: %+v\n", name, v)
+		})
+		s.Channels.ForEach(func(name string, v interface{}) {
+			fmt.Printf("%s: %+v\n", name, v)
+		})
+
+		target := m.Params[0]
+		if !s.isChannelLocked(target) {
+			// A message sent directly to us - log it under the
+			// sender's nick so it shows up in their query history.
+			target = m.Prefix.Name
+		}
+
+		s.logEvent(target, m.Command, m.Prefix.Name, nil, m.Trailing())
 	})
 
 	return s, nil
@@ -249,8 +427,8 @@ func (s *State) clear() {
 	s.prefixModes = make(map[rune]rune)
 	s.modePrefixes = make(map[rune]rune)
 
-	s.Channels = make(map[string]*ChannelState)
-	s.Users = make(map[string]*UserState)
+	s.Channels = s.newCasemapMap()
+	s.Users = s.newCasemapMap()
 
 	// Create a bogus message to send through callback004 to set
 	// some defaults we're missing.
@@ -259,7 +437,7 @@ func (s *State) clear() {
 		Command: "004",
 		Params:  []string{"", "", "", "Oiorw"},
 	}
-	s.callback004(nil, m)
+	s.applyMyInfo(m)
 
 	// Create a bogus message to send through callback005 so we
 	// ensure any defaults which would have set special values
@@ -267,17 +445,23 @@ func (s *State) clear() {
 	m = &irc.Message{
 		Prefix:  &irc.Prefix{},
 		Command: "005",
-		Params:  []string{},
+		// applyISupport skips Params[0] (it's the nick on a real
+		// 005), so this needs a placeholder or the first default
+		// token appended below would be silently dropped.
+		Params: []string{""},
 	}
 	for k := range isupportDefaults {
 		m.Params = append(m.Params, "-"+k)
 	}
 	m.Params = append(m.Params, "are supported by this server.")
 
-	s.callback005(nil, m)
+	s.applyISupport(m)
 }
 
 func (s *State) joinCallback(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	cname := m.Params[0]
 	uname := m.Prefix.Name
 
@@ -293,7 +477,7 @@ func (s *State) joinCallback(b *bot.Bot, m *irc.Message) {
 		// what we need.
 		b.Writef("WHO :%s", cname)
 	} else {
-		if !s.UserInChannel(s.currentNick, cname) {
+		if !s.userInChannelLocked(s.currentNick, cname) {
 			// TODO: Log warning
 			return
 		}
@@ -302,11 +486,29 @@ func (s *State) joinCallback(b *bot.Bot, m *irc.Message) {
 		b.Writef("WHO :%s", uname)
 	}
 
-	s.ensureUserInChannel(uname, cname)
+	u, c := s.ensureUserInChannel(uname, cname)
+	delete(c.Invites, s.Normalize(uname))
 
+	// With extended-join, JOIN carries the user's account and
+	// realname as well, saving us a WHO just to learn them.
+	if len(m.Params) > 1 {
+		account := m.Params[1]
+		if account == "*" {
+			account = ""
+		}
+
+		u.Account = account
+		u.Realname = m.Trailing()
+	}
+
+	s.emit(UserJoined{User: uname, Channel: cname})
+	s.logEvent(cname, "JOIN", uname, nil, "")
 }
 
 func (s *State) partCallback(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	cname := m.Params[0]
 	uname := m.Prefix.Name
 
@@ -316,22 +518,94 @@ func (s *State) partCallback(b *bot.Bot, m *irc.Message) {
 	}
 
 	s.ensureUserNotInChannel(uname, cname)
+	s.emit(UserParted{User: uname, Channel: cname})
+	s.logEvent(cname, "PART", uname, nil, m.Trailing())
 }
 
+// rekeyAll re-casemaps every CasemapMap held by the state, used when
+// the server's active CASEMAPPING changes mid-session so that
+// previously-stored entries don't become unreachable.
+func (s *State) rekeyAll() {
+	s.Channels.Rekey()
+	s.Users.Rekey()
+
+	s.Channels.ForEach(func(_ string, v interface{}) {
+		c := v.(*ChannelState)
+
+		// UserPrefixes, modesByUser and Invites are plain maps keyed
+		// by normalized nick rather than CasemapMaps, so they don't
+		// get re-keyed for free - move each entry over using the
+		// old->new key mapping Users.Rekey() hands back, or they'd
+		// become unreachable under the new casemapping.
+		moved := c.Users.Rekey()
+		for oldKey, newKey := range moved {
+			if oldKey == newKey {
+				continue
+			}
+
+			if modes, ok := c.modesByUser[oldKey]; ok {
+				delete(c.modesByUser, oldKey)
+				c.modesByUser[newKey] = modes
+			}
+
+			if prefixes, ok := c.UserPrefixes[oldKey]; ok {
+				delete(c.UserPrefixes, oldKey)
+				c.UserPrefixes[newKey] = prefixes
+			}
+
+			if invitedAt, ok := c.Invites[oldKey]; ok {
+				delete(c.Invites, oldKey)
+				c.Invites[newKey] = invitedAt
+			}
+		}
+	})
+
+	s.Users.ForEach(func(_ string, v interface{}) {
+		v.(*UserState).Channels.Rekey()
+	})
+}
+
+// IsChannel returns whether name looks like a channel name, as
+// determined by the server's CHANTYPES.
 func (s *State) IsChannel(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.isChannelLocked(name)
+}
+
+func (s *State) isChannelLocked(name string) bool {
 	r, size := utf8.DecodeRuneInString(name)
 	return size != 0 && s.chanTypes[r]
 }
 
 func (s *State) modeCallback(b *bot.Bot, m *irc.Message) {
-	log.Printf("%+v", m)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	target := m.Params[0]
 	modestring := m.Params[1]
 	msgParams := m.Params[2:]
 
-	isChannel := s.IsChannel(target)
+	if !s.isChannelLocked(target) {
+		// We don't currently track user modes other than our own,
+		// set in callback004.
+		return
+	}
+
+	c := s.ensureChannel(target)
+	s.applyChannelModes(c, target, modestring, msgParams, m.Prefix.Name, time.Now(), true)
+	s.logEvent(target, "MODE", m.Prefix.Name, msgParams, modestring)
+}
 
+// applyChannelModes parses a mode string (as given by a MODE command or
+// RPL_CHANNELMODEIS) and the params which go along with it, mutating c
+// to reflect the changes. who and when are recorded against any
+// type-A (list) modes which get added. notify controls whether
+// ModeChanged/PrefixChanged events are emitted; it should be false
+// when applying a full resync (e.g. RPL_CHANNELMODEIS) rather than an
+// actual change.
+func (s *State) applyChannelModes(c *ChannelState, channel, modestring string, msgParams []string, who string, when time.Time, notify bool) {
 	// Convenience function to modify the slice and pop the first param
 	popParam := func() (string, error) {
 		if len(msgParams) == 0 {
@@ -348,75 +622,169 @@ func (s *State) modeCallback(b *bot.Bot, m *irc.Message) {
 	for _, v := range modestring {
 		if v == '+' || v == '-' {
 			state = v
-		} else if isChannel {
-			if ok := s.chanModes[0][v]; ok {
-				// list-like (always take param)
-				p, err := popParam()
-				if err != nil {
-					continue
-				}
+		} else if ok := s.chanModes[0][v]; ok {
+			// list-like (always take param)
+			p, err := popParam()
+			if err != nil {
+				continue
+			}
 
-				if state == '+' {
-					log.Printf("Adding %s to list for mode %s", p, string(v))
-				} else {
-					log.Printf("Removing %s from list for mode %s", p, string(v))
-				}
-			} else if ok := s.chanModes[1][v]; ok {
-				// key-like (always take param)
-				p, err := popParam()
-				if err != nil {
-					continue
-				}
+			list, ok := c.Lists[v]
+			if !ok {
+				list = make(map[string]MaskEntry)
+				c.Lists[v] = list
+			}
 
-				if state == '+' {
-					log.Printf("Setting mode %s with param %s", string(v), p)
-				} else {
-					log.Printf("Unsetting mode %s with param %s", string(v), p)
-				}
-			} else if ok := s.chanModes[2][v]; ok {
-				// limit-like (take param if in + state)
-				if state == '+' {
-					p, err := popParam()
-					if err != nil {
-						continue
-					}
-
-					log.Printf("Setting mode %s to %s", string(v), p)
-				} else {
-					log.Printf("Unsetting mode %s", string(v))
-				}
-			} else if ok := s.chanModes[3][v]; ok {
-				// settings (never take param)
-				if state == '+' {
-					log.Printf("Setting mode %s", string(v))
-				} else {
-					log.Printf("Unsetting mode %s", string(v))
-				}
-			} else if mp, ok := s.modePrefixes[v]; ok {
-				// user prefix (always take param)
-				p, err := popParam()
+			if state == '+' {
+				list[p] = MaskEntry{Mask: p, SetBy: who, SetAt: when}
+			} else {
+				delete(list, p)
+			}
+
+			if notify {
+				s.emit(ModeChanged{Channel: channel, Mode: v, Set: state == '+', Param: p})
+			}
+		} else if ok := s.chanModes[1][v]; ok {
+			// key-like (always take param)
+			p, err := popParam()
+			if err != nil {
+				continue
+			}
+
+			if state == '+' {
+				c.Modes[v] = p
+			} else {
+				delete(c.Modes, v)
+			}
+
+			if notify {
+				s.emit(ModeChanged{Channel: channel, Mode: v, Set: state == '+', Param: p})
+			}
+		} else if ok := s.chanModes[2][v]; ok {
+			// limit-like (take param if in + state)
+			var p string
+			if state == '+' {
+				var err error
+				p, err = popParam()
 				if err != nil {
 					continue
 				}
 
-				if state == '+' {
-					log.Printf("Setting prefix %s (%s) on user %s", string(mp), string(v), p)
-				} else {
-					log.Printf("Unsetting prefix %s (%s) on user %s", string(mp), string(v), p)
-				}
+				c.Modes[v] = p
+			} else {
+				delete(c.Modes, v)
 			}
-		} else {
+
+			if notify {
+				s.emit(ModeChanged{Channel: channel, Mode: v, Set: state == '+', Param: p})
+			}
+		} else if ok := s.chanModes[3][v]; ok {
+			// settings (never take param)
 			if state == '+' {
-				log.Printf("Setting user mode %s", string(v))
+				c.Modes[v] = ""
 			} else {
-				log.Printf("Unsetting user mode %s", string(v))
+				delete(c.Modes, v)
+			}
+
+			if notify {
+				s.emit(ModeChanged{Channel: channel, Mode: v, Set: state == '+'})
+			}
+		} else if _, ok := s.modePrefixes[v]; ok {
+			// user prefix (always take param)
+			p, err := popParam()
+			if err != nil {
+				continue
+			}
+
+			s.setUserPrefix(c, channel, p, v, state == '+', notify)
+		}
+	}
+}
+
+// setUserPrefix adds or removes the given prefix mode letter for user
+// in c, then recomputes the sorted UserPrefixes entry for that user.
+// If notify is true, a PrefixChanged event is emitted.
+func (s *State) setUserPrefix(c *ChannelState, channel, user string, mode rune, set, notify bool) {
+	normalizedUser := s.Normalize(user)
+
+	modes, ok := c.modesByUser[normalizedUser]
+	if !ok {
+		modes = make(map[rune]bool)
+		c.modesByUser[normalizedUser] = modes
+	}
+
+	if set {
+		modes[mode] = true
+	} else {
+		delete(modes, mode)
+	}
+
+	if len(modes) == 0 {
+		delete(c.modesByUser, normalizedUser)
+		delete(c.UserPrefixes, normalizedUser)
+	} else {
+		var prefixes []rune
+		for _, mode := range s.prefixOrder {
+			if modes[mode] {
+				prefixes = append(prefixes, s.modePrefixes[mode])
 			}
 		}
+
+		c.UserPrefixes[normalizedUser] = string(prefixes)
 	}
 
+	if notify {
+		s.emit(PrefixChanged{User: user, Channel: channel, Prefix: s.modePrefixes[mode], Set: set})
+	}
+}
+
+// ChannelHasMode returns the value of the given mode in channel (the
+// empty string for parameterless modes) and whether it is currently
+// set.
+func (s *State) ChannelHasMode(channel string, mode rune) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.channelHasModeLocked(channel, mode)
+}
+
+func (s *State) channelHasModeLocked(channel string, mode rune) (string, bool) {
+	c, ok := s.getChannel(channel)
+	if !ok {
+		return "", false
+	}
+
+	v, ok := c.Modes[mode]
+	return v, ok
+}
+
+// UserHasPrefix returns whether user currently holds prefix in
+// channel.
+func (s *State) UserHasPrefix(user, channel string, prefix rune) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.userHasPrefixLocked(user, channel, prefix)
+}
+
+func (s *State) userHasPrefixLocked(user, channel string, prefix rune) bool {
+	c, ok := s.getChannel(channel)
+	if !ok {
+		return false
+	}
+
+	prefixes, ok := c.UserPrefixes[s.Normalize(user)]
+	if !ok {
+		return false
+	}
+
+	return strings.ContainsRune(prefixes, prefix)
 }
 
 func (s *State) quitCallback(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	uname := m.Prefix.Name
 	log.Printf("%s has quit", uname)
 	if uname == s.currentNick {
@@ -425,10 +793,25 @@ func (s *State) quitCallback(b *bot.Bot, m *irc.Message) {
 		// matter what we do.
 	}
 
+	var channels []string
+	if u, ok := s.getUser(uname); ok {
+		u.Channels.ForEach(func(cname string, _ interface{}) {
+			channels = append(channels, cname)
+		})
+	}
+
 	s.removeUser(uname)
+	s.emit(UserQuit{User: uname})
+
+	for _, cname := range channels {
+		s.logEvent(cname, "QUIT", uname, nil, m.Trailing())
+	}
 }
 
 func (s *State) kickCallback(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	cname := m.Params[0]
 	uname := m.Params[1]
 	log.Printf("%s has been kicked from %s\n", uname, cname)
@@ -437,9 +820,13 @@ func (s *State) kickCallback(b *bot.Bot, m *irc.Message) {
 	}
 
 	s.ensureUserNotInChannel(uname, cname)
+	s.emit(UserParted{User: uname, Channel: cname})
 }
 
 func (s *State) nickCallback(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	oldNick := m.Prefix.Name
 	newNick := m.Params[0]
 	log.Printf("%s changed nick to %s\n", oldNick, newNick)
@@ -450,16 +837,115 @@ func (s *State) nickCallback(b *bot.Bot, m *irc.Message) {
 	}
 
 	s.renameUser(oldNick, newNick)
+	s.emit(NickChanged{OldNick: oldNick, NewNick: newNick})
+
+	if u, ok := s.getUser(newNick); ok {
+		u.Channels.ForEach(func(cname string, _ interface{}) {
+			s.logEvent(cname, "NICK", oldNick, nil, newNick)
+		})
+	}
+}
+
+// AWAY (away-notify)
+func (s *State) awayCallback(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	uname := m.Prefix.Name
+
+	u, ok := s.getUser(uname)
+	if !ok {
+		return
+	}
+
+	// An AWAY with a message means the user is now away; an AWAY
+	// with no params means they're back.
+	u.Away = len(m.Params) > 0
+}
+
+// CHGHOST (chghost)
+func (s *State) chghostCallback(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	uname := m.Prefix.Name
+
+	u, ok := s.getUser(uname)
+	if !ok {
+		return
+	}
+
+	u.Username = m.Params[0]
+	u.Host = m.Params[1]
+}
+
+// SETNAME (setname)
+func (s *State) setnameCallback(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	uname := m.Prefix.Name
+
+	u, ok := s.getUser(uname)
+	if !ok {
+		return
+	}
+
+	u.Realname = m.Trailing()
+}
+
+// ACCOUNT (account-notify)
+func (s *State) accountCallback(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	uname := m.Prefix.Name
+
+	u, ok := s.getUser(uname)
+	if !ok {
+		return
+	}
+
+	account := m.Params[0]
+	if account == "*" {
+		account = ""
+	}
+
+	u.Account = account
+}
+
+// INVITE (invite-notify)
+func (s *State) inviteCallback(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nick := m.Params[0]
+	cname := m.Params[1]
+
+	c := s.ensureChannel(cname)
+	c.Invites[s.Normalize(nick)] = time.Now()
 }
 
 // RPL_WELCOME
 func (s *State) callback001(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.currentNick = m.Params[0]
 	s.clear()
 }
 
 // RPL_MYINFO
 func (s *State) callback004(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.applyMyInfo(m)
+}
+
+// applyMyInfo does the actual work of callback004. It's split out so
+// clear() can seed defaults without taking s.mu twice.
+func (s *State) applyMyInfo(m *irc.Message) {
 	// NOTE: This would work for more than userModes, but we set a
 	// number of other things in 005 so there's no point setting
 	// them here. Plus, for compatibility, we can only get a
@@ -474,6 +960,9 @@ func (s *State) callback004(b *bot.Bot, m *irc.Message) {
 
 // RPL_WHOREPLY
 func (s *State) callback352(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	// <source> 352 <target> <channel> <user> <host> <server> <nick> <flags> :<distance> <realname>
 	// :kenny.chatspike.net 352 guest #test grawity broken.symlink *.chatspike.net grawity H@%+ :0 Mantas M.
 	var (
@@ -484,21 +973,41 @@ func (s *State) callback352(b *bot.Bot, m *irc.Message) {
 		// server  = m.Params[4]
 		nick  = m.Params[5]
 		flags = m.Params[6]
-		// rest = m.Params[7] // Or m.Trailing()
 	)
 
-	log.Printf("Flags for %s!%s@%s on %s: %s", nick, user, host, channel, flags)
+	// The trailing param is "<distance> <realname>" - we only care
+	// about the realname.
+	_, realname := splitFirstWord(m.Trailing())
+
+	us, cs := s.ensureUserInChannel(nick, channel)
+	us.Username = user
+	us.Host = host
+	us.Realname = realname
+
 	if flags[0] == 'H' {
-		log.Println("User is here")
+		us.Away = false
 		flags = flags[1:]
 	} else if flags[0] == 'G' {
-		log.Println("User is away")
+		us.Away = true
 		flags = flags[1:]
 	}
 
-	for _, c := range flags {
-		log.Printf("User has prefix %s (%s)", string(c), string(s.prefixModes[c]))
+	for _, p := range flags {
+		if _, ok := s.prefixModes[p]; ok {
+			s.setUserPrefix(cs, channel, nick, s.prefixModes[p], true, false)
+		}
+	}
+}
+
+// splitFirstWord splits s on the first space, returning the first
+// word and the remainder.
+func splitFirstWord(s string) (string, string) {
+	parts := strings.SplitN(s, " ", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
 	}
+
+	return parts[0], parts[1]
 }
 
 // RPL_ENDOFWHO
@@ -509,6 +1018,9 @@ func (s *State) callback315(b *bot.Bot, m *irc.Message) {
 
 // RPL_NAMES
 func (s *State) callback353(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	// :hades.arpa 353 guest = #tethys :~&@%+aji &@Attila @+alyx +KindOne Argure
 	channel := m.Params[2]
 	for _, name := range strings.Split(m.Trailing(), " ") {
@@ -535,3 +1047,178 @@ func (s *State) callback366(b *bot.Bot, m *irc.Message) {
 	// :hades.arpa 366 guest #tethys :End of /NAMES list.
 	log.Printf("End of NAMES for %s", m.Params[1])
 }
+
+// RPL_CHANNELMODEIS
+func (s *State) callback324(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// <client> <channel> <modestring> <mode arguments>...
+	channel := m.Params[1]
+	modestring := m.Params[2]
+	msgParams := m.Params[3:]
+
+	c := s.ensureChannel(channel)
+	c.Modes = make(map[rune]string)
+	s.applyChannelModes(c, channel, modestring, msgParams, "", time.Now(), false)
+}
+
+// RPL_CREATIONTIME
+func (s *State) callback329(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// <client> <channel> <creationtime>
+	c := s.ensureChannel(m.Params[1])
+
+	unix, err := strconv.ParseInt(m.Params[2], 10, 64)
+	if err != nil {
+		return
+	}
+
+	c.CreatedAt = time.Unix(unix, 0)
+}
+
+// TOPIC
+func (s *State) topicCallback(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.ensureChannel(m.Params[0])
+
+	c.Topic = m.Trailing()
+	c.TopicSetBy = m.Prefix.Name
+	c.TopicSetAt = time.Now()
+
+	s.emit(TopicChanged{Channel: m.Params[0], Topic: c.Topic, SetBy: c.TopicSetBy})
+	s.logEvent(m.Params[0], "TOPIC", c.TopicSetBy, nil, c.Topic)
+}
+
+// RPL_TOPIC
+func (s *State) callback332(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// <client> <channel> <topic>
+	c := s.ensureChannel(m.Params[1])
+	c.Topic = m.Trailing()
+}
+
+// RPL_TOPICWHOTIME
+func (s *State) callback333(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// <client> <channel> <nick> <setat>
+	c := s.ensureChannel(m.Params[1])
+	c.TopicSetBy = m.Params[2]
+
+	unix, err := strconv.ParseInt(m.Params[3], 10, 64)
+	if err != nil {
+		return
+	}
+
+	c.TopicSetAt = time.Unix(unix, 0)
+}
+
+// RPL_CHANNEL_URL
+func (s *State) callback328(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// <client> <channel> <url>
+	c := s.ensureChannel(m.Params[1])
+	c.URL = m.Trailing()
+}
+
+func (s *State) addMaskEntry(channel string, mode rune, mask, who string, ts string) {
+	c := s.ensureChannel(channel)
+
+	list, ok := c.Lists[mode]
+	if !ok {
+		list = make(map[string]MaskEntry)
+		c.Lists[mode] = list
+	}
+
+	entry := MaskEntry{Mask: mask, SetBy: who}
+	if unix, err := strconv.ParseInt(ts, 10, 64); err == nil {
+		entry.SetAt = time.Unix(unix, 0)
+	}
+
+	list[mask] = entry
+}
+
+// RPL_INVITELIST
+func (s *State) callback346(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// <client> <channel> <mask> [<who> <set-ts>]
+	channel := m.Params[1]
+	mask := m.Params[2]
+
+	var who, ts string
+	if len(m.Params) > 3 {
+		who = m.Params[3]
+	}
+	if len(m.Params) > 4 {
+		ts = m.Params[4]
+	}
+
+	s.addMaskEntry(channel, 'I', mask, who, ts)
+}
+
+// RPL_ENDOFINVITELIST
+func (s *State) callback347(b *bot.Bot, m *irc.Message) {
+	log.Printf("End of invite list for %s", m.Params[1])
+}
+
+// RPL_EXCEPTLIST
+func (s *State) callback348(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// <client> <channel> <mask> [<who> <set-ts>]
+	channel := m.Params[1]
+	mask := m.Params[2]
+
+	var who, ts string
+	if len(m.Params) > 3 {
+		who = m.Params[3]
+	}
+	if len(m.Params) > 4 {
+		ts = m.Params[4]
+	}
+
+	s.addMaskEntry(channel, 'e', mask, who, ts)
+}
+
+// RPL_ENDOFEXCEPTLIST
+func (s *State) callback349(b *bot.Bot, m *irc.Message) {
+	log.Printf("End of except list for %s", m.Params[1])
+}
+
+// RPL_BANLIST
+func (s *State) callback367(b *bot.Bot, m *irc.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// <client> <channel> <mask> <who> <set-ts>
+	channel := m.Params[1]
+	mask := m.Params[2]
+
+	var who, ts string
+	if len(m.Params) > 3 {
+		who = m.Params[3]
+	}
+	if len(m.Params) > 4 {
+		ts = m.Params[4]
+	}
+
+	s.addMaskEntry(channel, 'b', mask, who, ts)
+}
+
+// RPL_ENDOFBANLIST
+func (s *State) callback368(b *bot.Bot, m *irc.Message) {
+	log.Printf("End of ban list for %s", m.Params[1])
+}
@@ -0,0 +1,168 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestState() *State {
+	s := &State{
+		subs: make(map[chan StateEvent]struct{}),
+	}
+	s.clear()
+
+	return s
+}
+
+func TestApplyChannelModes(t *testing.T) {
+	cases := []struct {
+		name       string
+		modestring string
+		params     []string
+		wantModes  map[rune]string
+		wantUnset  []rune
+		wantPrefix string
+	}{
+		{
+			name:       "settings mode",
+			modestring: "+n",
+			wantModes:  map[rune]string{'n': ""},
+		},
+		{
+			name:       "key-like mode",
+			modestring: "+k",
+			params:     []string{"hunter2"},
+			wantModes:  map[rune]string{'k': "hunter2"},
+		},
+		{
+			name:       "limit-like mode set",
+			modestring: "+l",
+			params:     []string{"50"},
+			wantModes:  map[rune]string{'l': "50"},
+		},
+		{
+			name:       "limit-like mode unset takes no param",
+			modestring: "-l",
+			wantUnset:  []rune{'l'},
+		},
+		{
+			name:       "user prefix mode",
+			modestring: "+o",
+			params:     []string{"alice"},
+			wantPrefix: "@",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestState()
+			c := s.ensureChannel("#test")
+
+			s.applyChannelModes(c, "#test", tc.modestring, tc.params, "bob", time.Now(), false)
+
+			for mode, want := range tc.wantModes {
+				got, ok := c.Modes[mode]
+				if want == "" && !ok {
+					t.Errorf("mode %q: want set with empty value, not set", string(mode))
+				} else if got != want {
+					t.Errorf("mode %q: got %q, want %q", string(mode), got, want)
+				}
+			}
+
+			for _, mode := range tc.wantUnset {
+				if _, ok := c.Modes[mode]; ok {
+					t.Errorf("mode %q: want unset, still present", string(mode))
+				}
+			}
+
+			if tc.wantPrefix != "" {
+				if got := c.UserPrefixes[s.Normalize("alice")]; got != tc.wantPrefix {
+					t.Errorf("prefixes for alice: got %q, want %q", got, tc.wantPrefix)
+				}
+			}
+		})
+	}
+}
+
+func TestRekeyAllPreservesPrefixesAndInvites(t *testing.T) {
+	s := newTestState()
+	c := s.ensureChannel("#test")
+
+	// '^' lowercases to '~' under the default rfc1459 casemapping but
+	// is left alone under ascii, so switching CASEMAPPING to ascii
+	// changes this nick's normalized form and forces a rekey.
+	s.ensureUserInChannel("alice^", "#test")
+	s.applyChannelModes(c, "#test", "+o", []string{"alice^"}, "bob", time.Now(), false)
+	c.Invites[s.Normalize("alice^")] = time.Now()
+
+	if !s.userHasPrefixLocked("alice^", "#test", '@') {
+		t.Fatal("alice^ should hold @ before the CASEMAPPING change")
+	}
+
+	s.applyISupport(fakeISupportMessage("CASEMAPPING=ascii"))
+
+	if !s.userInChannelLocked("alice^", "#test") {
+		t.Error("alice^ should still be found in #test after CASEMAPPING change (CasemapMap-backed)")
+	}
+
+	if !s.userHasPrefixLocked("alice^", "#test", '@') {
+		t.Error("alice^ should still hold @ after CASEMAPPING change (plain map, needs rekeyAll to move it)")
+	}
+
+	if _, ok := c.Invites[s.Normalize("alice^")]; !ok {
+		t.Error("alice^'s invite should still be tracked after CASEMAPPING change (plain map, needs rekeyAll to move it)")
+	}
+}
+
+func TestEnsureUserNotInChannelClearsPrefixes(t *testing.T) {
+	s := newTestState()
+	c := s.ensureChannel("#test")
+
+	s.ensureUserInChannel("alice", "#test")
+	s.applyChannelModes(c, "#test", "+o", []string{"alice"}, "bob", time.Now(), false)
+
+	if !s.userHasPrefixLocked("alice", "#test", '@') {
+		t.Fatal("alice should hold @ before parting")
+	}
+
+	s.ensureUserNotInChannel("alice", "#test")
+
+	// Rejoining with no fresh MODE/WHO should not resurrect the
+	// pre-departure prefix.
+	s.ensureUserInChannel("alice", "#test")
+
+	if s.userHasPrefixLocked("alice", "#test", '@') {
+		t.Error("alice should not hold @ after parting and rejoining with no fresh MODE")
+	}
+}
+
+func TestRenameUserPreservesPrefixes(t *testing.T) {
+	s := newTestState()
+	c := s.ensureChannel("#test")
+
+	s.ensureUserInChannel("alice", "#test")
+	s.applyChannelModes(c, "#test", "+o", []string{"alice"}, "bob", time.Now(), false)
+	c.Invites[s.Normalize("alice")] = time.Now()
+
+	if !s.userHasPrefixLocked("alice", "#test", '@') {
+		t.Fatal("alice should hold @ before rename")
+	}
+
+	s.renameUser("alice", "alice2")
+
+	if s.userHasPrefixLocked("alice", "#test", '@') {
+		t.Error("old nick should no longer hold @ after rename")
+	}
+
+	if !s.userHasPrefixLocked("alice2", "#test", '@') {
+		t.Error("new nick should hold @ after rename")
+	}
+
+	if _, ok := c.Invites[s.Normalize("alice")]; ok {
+		t.Error("old nick's invite should be moved, not left behind, after rename")
+	}
+
+	if _, ok := c.Invites[s.Normalize("alice2")]; !ok {
+		t.Error("new nick should hold the invite after rename")
+	}
+}
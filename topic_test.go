@@ -0,0 +1,111 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/belak/irc"
+)
+
+func TestTopicCallback(t *testing.T) {
+	s := newTestState()
+
+	s.topicCallback(nil, &irc.Message{
+		Prefix:  &irc.Prefix{Name: "alice"},
+		Command: "TOPIC",
+		Params:  []string{"#test", "new topic"},
+	})
+
+	c, ok := s.getChannel("#test")
+	if !ok {
+		t.Fatal("#test should have been created")
+	}
+
+	if c.Topic != "new topic" || c.TopicSetBy != "alice" {
+		t.Errorf("Topic/TopicSetBy: got %q/%q, want \"new topic\"/\"alice\"", c.Topic, c.TopicSetBy)
+	}
+
+	if c.TopicSetAt.IsZero() {
+		t.Error("TopicSetAt should be set")
+	}
+}
+
+func TestCallback332SetsTopic(t *testing.T) {
+	s := newTestState()
+
+	s.callback332(nil, &irc.Message{
+		Prefix:  &irc.Prefix{},
+		Command: "332",
+		Params:  []string{"bot", "#test", "the topic"},
+	})
+
+	c, ok := s.getChannel("#test")
+	if !ok {
+		t.Fatal("#test should have been created")
+	}
+
+	if c.Topic != "the topic" {
+		t.Errorf("Topic: got %q, want \"the topic\"", c.Topic)
+	}
+}
+
+func TestCallback333SetsTopicWhoTime(t *testing.T) {
+	s := newTestState()
+
+	s.callback333(nil, &irc.Message{
+		Prefix:  &irc.Prefix{},
+		Command: "333",
+		Params:  []string{"bot", "#test", "alice", "1600000000"},
+	})
+
+	c, ok := s.getChannel("#test")
+	if !ok {
+		t.Fatal("#test should have been created")
+	}
+
+	if c.TopicSetBy != "alice" {
+		t.Errorf("TopicSetBy: got %q, want \"alice\"", c.TopicSetBy)
+	}
+
+	if !c.TopicSetAt.Equal(time.Unix(1600000000, 0)) {
+		t.Errorf("TopicSetAt: got %v, want %v", c.TopicSetAt, time.Unix(1600000000, 0))
+	}
+}
+
+func TestCallback329SetsCreatedAt(t *testing.T) {
+	s := newTestState()
+
+	s.callback329(nil, &irc.Message{
+		Prefix:  &irc.Prefix{},
+		Command: "329",
+		Params:  []string{"bot", "#test", "1600000000"},
+	})
+
+	c, ok := s.getChannel("#test")
+	if !ok {
+		t.Fatal("#test should have been created")
+	}
+
+	if !c.CreatedAt.Equal(time.Unix(1600000000, 0)) {
+		t.Errorf("CreatedAt: got %v, want %v", c.CreatedAt, time.Unix(1600000000, 0))
+	}
+}
+
+func TestCallback328SetsURL(t *testing.T) {
+	s := newTestState()
+
+	s.callback328(nil, &irc.Message{
+		Prefix:  &irc.Prefix{},
+		Command: "328",
+		Params:  []string{"bot", "#test", "https://example.com"},
+	})
+
+	c, ok := s.getChannel("#test")
+	if !ok {
+		t.Fatal("#test should have been created")
+	}
+
+	if c.URL != "https://example.com" {
+		t.Errorf("URL: got %q, want \"https://example.com\"", c.URL)
+	}
+}